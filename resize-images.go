@@ -1,23 +1,44 @@
-// Resizes all the JPEGs in a directory to a list
+// Resizes all the images in a directory to a list
 // of sizes and stores them in a new directory.
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"image"
+	"image/gif"
 	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"text/template"
 
+	"github.com/chai2010/webp"
 	"github.com/disintegration/imaging"
+	"github.com/jdeng/goheif"
+	"github.com/rwcarlsen/goexif/exif"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+	"golang.org/x/sync/errgroup"
 )
 
-var fromPath, toPath, sizesString string
+var fromPath, toPath, sizesString, outFormat, pngCompression, layout, manifestPath, extString, excludeString, nameTemplateString string
+var jpegQuality, jobs int
+var webpLossless, followSymlinks, preserveExif, stripExif bool
 
 func init() {
 	fromPath = "."
@@ -26,12 +47,153 @@ func init() {
 	toPath = "."
 	flag.StringVar(&toPath, "t", toPath, "directory to store resized images")
 
-	flag.StringVar(&sizesString, "s", "", "comma-separated list of sizes")
+	flag.StringVar(&sizesString, "s", "", `comma-separated list of sizes, either a bare integer (e.g. "200") or a named profile "name=WxH:fit" (e.g. "thumb=200x200:fill"); a 0 dimension is computed to preserve aspect ratio`)
+
+	outFormat = "keep"
+	flag.StringVar(&outFormat, "out-format", outFormat, "output format: jpeg, png, gif, webp, or keep to preserve each source's format")
+
+	jpegQuality = 90
+	flag.IntVar(&jpegQuality, "jpeg-quality", jpegQuality, "quality (1-100) used when encoding jpeg output")
+
+	pngCompression = "default"
+	flag.StringVar(&pngCompression, "png-compression", pngCompression, "png compression level: none, fastest, default, or best")
+
+	flag.BoolVar(&webpLossless, "webp-lossless", webpLossless, "encode webp output losslessly instead of with lossy quality")
+
+	layout = "name"
+	flag.StringVar(&layout, "layout", layout, "output layout: name (templated filename mirroring the source tree) or cas (content-addressable, deduplicated)")
+
+	nameTemplateString = "{{.Name}}_{{.Size}}{{.Ext}}"
+	flag.StringVar(&nameTemplateString, "name-template", nameTemplateString, "Go text/template for output filenames under -layout=name; variables: Name, Size, Width, Height, Hash, Ext")
+
+	flag.StringVar(&manifestPath, "manifest", "", "path to write a JSON manifest mapping original filenames to resized outputs")
+
+	jobs = runtime.NumCPU()
+	flag.IntVar(&jobs, "jobs", jobs, "number of images to decode and resize concurrently")
+
+	extString = ".jpg,.jpeg,.png,.gif,.webp,.tif,.tiff,.heic,.heif,.avif"
+	flag.StringVar(&extString, "ext", extString, "comma-separated list of file extensions to resize")
+
+	flag.StringVar(&excludeString, "exclude", "", "comma-separated glob patterns to exclude, matched against each file's path relative to -f")
+
+	flag.BoolVar(&followSymlinks, "follow-symlinks", followSymlinks, "follow symlinks, to files and to directories, while walking -f; without it they are skipped")
+
+	flag.BoolVar(&preserveExif, "preserve-exif", preserveExif, "re-embed a stripped-down EXIF block (DateTimeOriginal, Make/Model, GPS, copyright) in resized jpeg output")
+
+	flag.BoolVar(&stripExif, "strip-exif", stripExif, "never embed any EXIF metadata in resized output")
+}
+
+// imgFormat identifies one of the image formats this tool can read or write.
+type imgFormat string
+
+const (
+	formatJPEG imgFormat = "jpeg"
+	formatPNG  imgFormat = "png"
+	formatGIF  imgFormat = "gif"
+	formatWebP imgFormat = "webp"
+	formatTIFF imgFormat = "tiff"
+	formatHEIF imgFormat = "heif"
+)
+
+// heifExts are the extensions dispatched to the HEIF/AVIF decoder, since
+// neither format is registered with the standard image package.
+var heifExts = map[string]bool{
+	".heic": true,
+	".heif": true,
+	".avif": true,
+}
+
+func parseFormat(s string) (imgFormat, error) {
+	switch imgFormat(strings.ToLower(s)) {
+	case formatJPEG, formatPNG, formatGIF, formatWebP, formatTIFF, formatHEIF:
+		return imgFormat(strings.ToLower(s)), nil
+	default:
+		return "", fmt.Errorf("%s is not a supported format", s)
+	}
+}
+
+func (f imgFormat) ext() string {
+	switch f {
+	case formatJPEG:
+		return ".jpg"
+	case formatPNG:
+		return ".png"
+	case formatGIF:
+		return ".gif"
+	case formatWebP:
+		return ".webp"
+	case formatTIFF:
+		return ".tiff"
+	case formatHEIF:
+		return ".heif"
+	default:
+		return ""
+	}
 }
 
 type imageData struct {
-	img  image.Image
-	name string
+	img    image.Image
+	name   string
+	relDir string
+	format imgFormat
+	exif   *exif.Exif // nil unless -preserve-exif is set and the source had readable EXIF data
+}
+
+// manifest maps each original image name to its resized outputs, keyed by
+// size profile name. It's written to -manifest, if set, once every image
+// has finished.
+var manifest = struct {
+	sync.Mutex
+	data map[string]map[string]string
+}{data: make(map[string]map[string]string)}
+
+func recordManifest(name string, sizeName string, path string) {
+	manifest.Lock()
+	defer manifest.Unlock()
+	if manifest.data[name] == nil {
+		manifest.data[name] = make(map[string]string)
+	}
+	manifest.data[name][sizeName] = path
+}
+
+func writeManifest(path string) error {
+	manifest.Lock()
+	defer manifest.Unlock()
+	b, err := json.MarshalIndent(manifest.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0644)
+}
+
+// multiErrors aggregates the per-file errors encountered while walking a
+// directory tree, instead of letting individual failures get lost behind
+// log.Println while the rest of the batch keeps running.
+type multiErrors struct {
+	mu   sync.Mutex
+	errs []error
+}
+
+func (m *multiErrors) add(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errs = append(m.errs, err)
+}
+
+func (m *multiErrors) Error() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lines := make([]string, len(m.errs))
+	for i, err := range m.errs {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (m *multiErrors) len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.errs)
 }
 
 func main() {
@@ -51,20 +213,87 @@ func main() {
 		log.Fatal("no sizes specified")
 	}
 
-	files, err := filepath.Glob(filepath.Join(fromPath, "*.jpg"))
+	if outFormat != "keep" {
+		format, err := parseFormat(outFormat)
+		if err != nil {
+			log.Fatal("can't parse -out-format:", err)
+		}
+		if format == formatTIFF || format == formatHEIF {
+			log.Fatalf("-out-format %s is not supported: encoding to tiff/heif is not implemented", outFormat)
+		}
+	}
+	if layout != "name" && layout != "cas" {
+		log.Fatal("can't parse -layout: must be name or cas")
+	}
+	if preserveExif && stripExif {
+		log.Fatal("-preserve-exif and -strip-exif are mutually exclusive")
+	}
+	if jobs < 1 {
+		log.Fatal("-jobs must be at least 1")
+	}
+
+	nameTemplate, err := template.New("name").Parse(nameTemplateString)
 	if err != nil {
-		log.Fatal("can't get image filenames:", err)
+		log.Fatal("can't parse -name-template:", err)
+	}
+
+	exts := parseExts(extString)
+	var excludes []string
+	if excludeString != "" {
+		excludes = strings.Split(excludeString, ",")
+	}
+
+	files, err := walkImages(fromPath, exts, excludes, followSymlinks)
+	if err != nil {
+		log.Fatal("can't walk", fromPath, ":", err)
 	}
 	if len(files) <= 0 {
 		log.Fatal("no images to resize")
 	}
 
-	images := make(chan *imageData, runtime.GOMAXPROCS(0))
-	go readImages(files, images)
+	errs := processFiles(files, sizes, toPath, jobs, nameTemplate)
 
-	finished := make(chan int, runtime.GOMAXPROCS(0))
-	go resizeImages(images, sizes, toPath, finished)
-	<-finished
+	if manifestPath != "" {
+		if err := writeManifest(manifestPath); err != nil {
+			log.Fatal("can't write manifest:", err)
+		}
+	}
+
+	if errs.len() > 0 {
+		log.Println(errs)
+		os.Exit(1)
+	}
+}
+
+// processFiles decodes and resizes files using a pool of workers bounded at
+// concurrency, so decoded images don't all pile up in memory at once.
+// Per-file errors are collected rather than aborting the whole run.
+func processFiles(files []fileItem, sizes []sizeSpec, toPath string, concurrency int, nameTemplate *template.Template) *multiErrors {
+	errs := &multiErrors{}
+
+	var g errgroup.Group
+	g.SetLimit(concurrency)
+
+	for _, item := range files {
+		item := item
+		g.Go(func() error {
+			img, err := readImage(item)
+			if err != nil {
+				errs.add(fmt.Errorf("%s: %w", item.path, err))
+				return nil
+			}
+
+			for _, spec := range sizes {
+				if err := resizeImage(img, spec, toPath, nameTemplate); err != nil {
+					errs.add(fmt.Errorf("%s: size %s: %w", item.path, spec.name, err))
+				}
+			}
+			return nil
+		})
+	}
+	g.Wait()
+
+	return errs
 }
 
 func try(errs ...error) {
@@ -92,93 +321,737 @@ func validateDirectory(path string, mustExist bool) error {
 	return nil
 }
 
-func parseSizes(s string) ([]int, error) {
+// fitMode selects how a source image is mapped onto a sizeSpec's target
+// dimensions, mirroring the imaging package calls they're built from.
+type fitMode string
+
+const (
+	fitModeFit       fitMode = "fit"       // imaging.Fit: scale down to fit within WxH, preserving aspect ratio
+	fitModeFill      fitMode = "fill"      // imaging.Fill: scale and center-crop to fill WxH exactly
+	fitModeFitWidth  fitMode = "fitwidth"  // imaging.Resize with height 0: scale to width, preserving aspect ratio
+	fitModeFitHeight fitMode = "fitheight" // imaging.Resize with width 0: scale to height, preserving aspect ratio
+	fitModeStretch   fitMode = "stretch"   // imaging.Resize with both dimensions set: scale to WxH, ignoring aspect ratio
+)
+
+func parseFitMode(s string) (fitMode, error) {
+	switch fitMode(s) {
+	case fitModeFit, fitModeFill, fitModeFitWidth, fitModeFitHeight, fitModeStretch:
+		return fitMode(s), nil
+	default:
+		return "", fmt.Errorf("%s is not a valid fit mode", s)
+	}
+}
+
+// sizeSpec is one named output profile: a target width/height (0 meaning
+// "computed to preserve aspect ratio") and how the source should be fit
+// into them.
+type sizeSpec struct {
+	name   string
+	width  int
+	height int
+	fit    fitMode
+}
+
+func parseSizes(s string) ([]sizeSpec, error) {
 	isComma := func(r rune) bool {
 		return r == ','
 	}
 
-	var sizes []int
+	var specs []sizeSpec
 	for _, t := range strings.FieldsFunc(s, isComma) {
-		i, err := strconv.ParseInt(t, 10, 0)
-		switch {
-		case err != nil && err.(*strconv.NumError).Err == strconv.ErrSyntax:
-			return nil, fmt.Errorf("%s is not a valid size", s)
-		case err != nil && err.(*strconv.NumError).Err == strconv.ErrRange:
-			return nil, fmt.Errorf("size %s is out of the valid range", s)
-		case i < 0:
-			return nil, fmt.Errorf("size %d is less than zero", i)
+		spec, err := parseSizeSpec(t)
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, spec)
+	}
+
+	return specs, nil
+}
+
+// parseSizeSpec parses one comma-separated entry from -s: either a bare
+// integer, kept for backwards compatibility and treated as a square
+// fitModeFit box named after the integer itself, or a named profile of the
+// form "name=WxH:fit".
+func parseSizeSpec(t string) (sizeSpec, error) {
+	if i, err := strconv.ParseInt(t, 10, 0); err == nil {
+		if i < 0 {
+			return sizeSpec{}, fmt.Errorf("size %d is less than zero", i)
 		}
+		return sizeSpec{name: t, width: int(i), height: int(i), fit: fitModeFit}, nil
+	}
 
-		sizes = append(sizes, int(i))
+	name, rest, ok := strings.Cut(t, "=")
+	if !ok || name == "" {
+		return sizeSpec{}, fmt.Errorf("%s is not a valid size", t)
+	}
+
+	dims, fitStr, hasFit := strings.Cut(rest, ":")
+	if !hasFit {
+		fitStr = string(fitModeFit)
+	}
+
+	width, height, err := parseDimensions(dims)
+	if err != nil {
+		return sizeSpec{}, fmt.Errorf("%s: %w", t, err)
+	}
+
+	fit, err := parseFitMode(fitStr)
+	if err != nil {
+		return sizeSpec{}, fmt.Errorf("%s: %w", t, err)
+	}
+
+	return sizeSpec{name: name, width: width, height: height, fit: fit}, nil
+}
+
+func parseDimensions(s string) (int, int, error) {
+	w, h, ok := strings.Cut(s, "x")
+	if !ok {
+		return 0, 0, fmt.Errorf("%s is not a valid WxH dimension", s)
+	}
+
+	width, err := strconv.ParseUint(w, 10, 31)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s is not a valid width", w)
+	}
+	height, err := strconv.ParseUint(h, 10, 31)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s is not a valid height", h)
 	}
 
-	return sizes, nil
+	return int(width), int(height), nil
+}
+
+// fileItem is one file found while walking fromPath, along with its path
+// relative to fromPath so the output tree can mirror the source tree.
+type fileItem struct {
+	path string
+	rel  string
 }
 
-func readImages(paths []string, c chan *imageData) {
-	finished := make(chan int, runtime.GOMAXPROCS(0))
-	for _, path := range paths {
-		go readImage(path, c, finished)
+func parseExts(s string) map[string]bool {
+	exts := make(map[string]bool)
+	for _, e := range strings.Split(s, ",") {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e == "" {
+			continue
+		}
+		if !strings.HasPrefix(e, ".") {
+			e = "." + e
+		}
+		exts[e] = true
+	}
+	return exts
+}
+
+// walkImages recursively finds every file under root whose extension is in
+// exts, skipping anything matched by excludes. Symlinks, whether to files or
+// to directories, are skipped unless followSymlinks is set; in that case,
+// each symlinked directory's resolved real path is tracked in visited so a
+// symlink cycle terminates instead of recursing forever.
+func walkImages(root string, exts map[string]bool, excludes []string, followSymlinks bool) ([]fileItem, error) {
+	visited := make(map[string]bool)
+	if followSymlinks {
+		if real, err := filepath.EvalSymlinks(root); err == nil {
+			visited[real] = true
+		}
 	}
+	return walkImagesVisited(root, "", exts, excludes, followSymlinks, visited)
+}
+
+// walkImagesVisited walks root, reporting each file's path relative to the
+// original -f directory by prepending prefix (root's own path relative to it).
+func walkImagesVisited(root, prefix string, exts map[string]bool, excludes []string, followSymlinks bool, visited map[string]bool) ([]fileItem, error) {
+	var files []fileItem
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, relErr := filepath.Rel(root, path)
+		if relErr != nil {
+			return relErr
+		}
+		rel = filepath.Join(prefix, rel)
+		if path != root && matchesAny(rel, excludes) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		if d.Type()&fs.ModeSymlink != 0 {
+			if !followSymlinks {
+				return nil
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				return nil
+			}
+			if info.IsDir() {
+				real, err := filepath.EvalSymlinks(path)
+				if err != nil {
+					return nil
+				}
+				if visited[real] {
+					return nil // already descended into this directory; a symlink cycle
+				}
+				visited[real] = true
+
+				// WalkDir doesn't descend into a symlink even as its root,
+				// so walk the resolved directory instead.
+				sub, err := walkImagesVisited(real, rel, exts, excludes, followSymlinks, visited)
+				if err != nil {
+					return err
+				}
+				files = append(files, sub...)
+				return nil
+			}
+		}
+
+		if !exts[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+
+		files = append(files, fileItem{path: path, rel: rel})
+		return nil
+	})
+
+	return files, err
+}
 
-	for i := 0; i < len(paths); i++ {
-		<-finished
+func matchesAny(rel string, patterns []string) bool {
+	for _, p := range patterns {
+		if ok, _ := filepath.Match(p, rel); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(p, filepath.Base(rel)); ok {
+			return true
+		}
 	}
-	close(c)
+	return false
 }
 
-func readImage(path string, images chan *imageData, finished chan int) {
-	log.Println("reading", path)
-	defer func() { finished <- 1 }()
-	file, err := os.Open(path)
+func readImage(item fileItem) (*imageData, error) {
+	log.Println("reading", item.path)
+	data, err := os.ReadFile(item.path)
 	if err != nil {
-		log.Println(err)
-		return
+		return nil, err
 	}
-	defer file.Close()
 
-	img, err := jpeg.Decode(file)
+	img, format, err := decodeImage(bytes.NewReader(data), item.path)
 	if err != nil {
-		log.Println(err)
-		return
+		return nil, err
 	}
 
-	images <- &imageData{
-		img,
-		strings.Replace(filepath.Base(path), filepath.Ext(path), "", -1),
+	x, err := exif.Decode(bytes.NewReader(data))
+	if err != nil {
+		x = nil // no EXIF data, or it isn't readable; proceed without it
+	} else if orientation := exifOrientation(x); orientation != 1 {
+		img = applyOrientation(img, orientation)
 	}
+	if !preserveExif {
+		x = nil
+	}
+
+	base := filepath.Base(item.rel)
+	return &imageData{
+		img:    img,
+		name:   strings.Replace(base, filepath.Ext(base), "", -1),
+		relDir: filepath.Dir(item.rel),
+		format: format,
+		exif:   x,
+	}, nil
 }
 
-func resizeImages(images chan *imageData, sizes []int, toPath string, allFinished chan int) {
-	finished := make(chan int, runtime.GOMAXPROCS(0))
-	count := 0
-	for i := range images {
-		for _, s := range sizes {
-			count++
-			go resizeImage(i, s, toPath, finished)
-		}
+// exifOrientation reads the EXIF Orientation tag, defaulting to 1 (normal,
+// no transform needed) if it's absent or unreadable.
+func exifOrientation(x *exif.Exif) int {
+	tag, err := x.Get(exif.Orientation)
+	if err != nil {
+		return 1
 	}
+	orientation, err := tag.Int(0)
+	if err != nil {
+		return 1
+	}
+	return orientation
+}
+
+// applyOrientation rotates/flips img so it displays upright, undoing
+// whatever the camera recorded in its EXIF Orientation tag. See the EXIF
+// spec's Orientation tag for the meaning of each of the 8 values.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return imaging.FlipH(img)
+	case 3:
+		return imaging.Rotate180(img)
+	case 4:
+		return imaging.FlipV(img)
+	case 5:
+		return imaging.Transpose(img)
+	case 6:
+		return imaging.Rotate270(img)
+	case 7:
+		return imaging.Transverse(img)
+	case 8:
+		return imaging.Rotate90(img)
+	default:
+		return img
+	}
+}
 
-	for i := 0; i < count; i++ {
-		<-finished
+// decodeImage decodes an image, dispatching on the sniffed format for
+// everything the standard image package knows how to register (jpeg, png,
+// gif, webp, tiff) and falling back to the HEIF/AVIF decoder by extension.
+func decodeImage(r io.Reader, path string) (image.Image, imgFormat, error) {
+	if heifExts[strings.ToLower(filepath.Ext(path))] {
+		img, err := goheif.Decode(r)
+		return img, formatHEIF, err
 	}
-	allFinished <- 1
+
+	img, name, err := image.Decode(r)
+	return img, imgFormat(name), err
 }
 
-func resizeImage(img *imageData, size int, basePath string, finished chan int) {
-	defer func() { finished <- 1 }()
-	path := filepath.Join(basePath, fmt.Sprintf("%s_%d.jpg", img.name, size))
+func resizeImage(img *imageData, spec sizeSpec, basePath string, nameTemplate *template.Template) error {
+	format := img.format
+	if outFormat != "keep" {
+		format, _ = parseFormat(outFormat)
+	} else if format == formatTIFF || format == formatHEIF {
+		// tiff and heif/avif can only be decoded, not (re-)encoded, so keep
+		// falls back to jpeg instead of failing every such source file.
+		format = formatJPEG
+	}
+
+	resized := fitImage(img.img, spec)
+
+	path, err := outputPath(img, resized.Pix, spec, format, basePath, nameTemplate)
+	if err != nil {
+		return err
+	}
+	manifestKey := filepath.Join(img.relDir, img.name)
+
+	if layout == "cas" {
+		// Only cas paths are content-addressed, so an existing file at path
+		// holds the same resized pixels in the same format. The hash is taken
+		// before encoding, so that file keeps whatever -jpeg-quality,
+		// -png-compression or -webp-lossless it was first written with.
+		// Under the default name layout the path is templated, not derived
+		// from content, and an existing file there may hold different
+		// pixels entirely, so it is always rewritten.
+		if _, err := os.Stat(path); err == nil {
+			log.Println("skipping (already exists)", path)
+			recordManifest(manifestKey, spec.name, path)
+			return nil
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
 	log.Println("creating", path)
 	file, err := os.Create(path)
 	if err != nil {
-		log.Println(err)
-		return
+		return err
 	}
 	defer file.Close()
 
-	resized := imaging.Fit(img.img, size, size, imaging.Lanczos)
+	var buf bytes.Buffer
+	if err := encodeImage(&buf, format, resized); err != nil {
+		return err
+	}
+
+	out := buf.Bytes()
+	if format == formatJPEG && preserveExif && img.exif != nil {
+		embedded, err := embedExif(out, img.exif)
+		if err != nil {
+			log.Println("can't preserve exif for", path, ":", err)
+		} else {
+			out = embedded
+		}
+	}
+
+	if _, err := file.Write(out); err != nil {
+		return err
+	}
+
+	recordManifest(manifestKey, spec.name, path)
+	return nil
+}
+
+// fitImage maps src onto spec's target dimensions using the imaging call
+// that corresponds to its fit mode.
+func fitImage(src image.Image, spec sizeSpec) *image.NRGBA {
+	// imaging.Fit and imaging.Fill return an empty image for a 0 dimension,
+	// so with one dimension 0, fit bounds only the other one and fill
+	// scales to the other one without cropping.
+	if (spec.width == 0) != (spec.height == 0) {
+		switch spec.fit {
+		case fitModeFit:
+			w, h := spec.width, spec.height
+			if w == 0 {
+				w = src.Bounds().Dx()
+			} else {
+				h = src.Bounds().Dy()
+			}
+			return imaging.Fit(src, w, h, imaging.Lanczos)
+		case fitModeFill:
+			return imaging.Resize(src, spec.width, spec.height, imaging.Lanczos)
+		}
+	}
+
+	switch spec.fit {
+	case fitModeFill:
+		return imaging.Fill(src, spec.width, spec.height, imaging.Center, imaging.Lanczos)
+	case fitModeFitWidth:
+		return imaging.Resize(src, spec.width, 0, imaging.Lanczos)
+	case fitModeFitHeight:
+		return imaging.Resize(src, 0, spec.height, imaging.Lanczos)
+	case fitModeStretch:
+		return imaging.Resize(src, spec.width, spec.height, imaging.Lanczos)
+	default:
+		return imaging.Fit(src, spec.width, spec.height, imaging.Lanczos)
+	}
+}
+
+// nameVars are the variables available to -name-template.
+type nameVars struct {
+	Name   string
+	Size   string
+	Width  int
+	Height int
+	Hash   string
+	Ext    string
+}
+
+// outputPath builds the path a resized image is written to. Under the
+// default name layout, the filename is rendered from -name-template and the
+// source's directory structure relative to -f is mirrored under basePath;
+// under -layout=cas, the path is derived from the hash of the resized
+// pixels and sharded to keep directories small, so it intentionally ignores
+// relDir and dedupes across the whole source tree.
+func outputPath(img *imageData, pixels []byte, spec sizeSpec, format imgFormat, basePath string, nameTemplate *template.Template) (string, error) {
+	sum := sha256.Sum256(pixels)
+	hash := hex.EncodeToString(sum[:])
+
+	if layout != "cas" {
+		var buf strings.Builder
+		vars := nameVars{
+			Name:   img.name,
+			Size:   spec.name,
+			Width:  spec.width,
+			Height: spec.height,
+			Hash:   hash,
+			Ext:    format.ext(),
+		}
+		if err := nameTemplate.Execute(&buf, vars); err != nil {
+			return "", err
+		}
+		return filepath.Join(basePath, img.relDir, buf.String()), nil
+	}
+
+	return filepath.Join(basePath, hash[:2], hash[:4], fmt.Sprintf("%s_%s%s", hash, spec.name, format.ext())), nil
+}
+
+// encodeImage encodes img as format, using the per-format options the user
+// configured via -jpeg-quality, -png-compression, and -webp-lossless.
+func encodeImage(w io.Writer, format imgFormat, img image.Image) error {
+	switch format {
+	case formatJPEG:
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: jpegQuality})
+	case formatPNG:
+		level, err := parsePNGCompression(pngCompression)
+		if err != nil {
+			return err
+		}
+		return (&png.Encoder{CompressionLevel: level}).Encode(w, img)
+	case formatGIF:
+		return gif.Encode(w, img, nil)
+	case formatWebP:
+		return webp.Encode(w, img, &webp.Options{Lossless: webpLossless, Quality: 80})
+	case formatTIFF:
+		return fmt.Errorf("encoding to tiff is not supported")
+	case formatHEIF:
+		return fmt.Errorf("encoding to heif/avif is not supported")
+	default:
+		return fmt.Errorf("unknown output format %q", format)
+	}
+}
+
+func parsePNGCompression(s string) (png.CompressionLevel, error) {
+	switch s {
+	case "none":
+		return png.NoCompression, nil
+	case "fastest":
+		return png.BestSpeed, nil
+	case "default":
+		return png.DefaultCompression, nil
+	case "best":
+		return png.BestCompression, nil
+	default:
+		return 0, fmt.Errorf("%s is not a valid png compression level", s)
+	}
+}
 
-	if err := jpeg.Encode(file, resized, nil); err != nil {
-		log.Println(err)
+// embedExif inserts a stripped-down EXIF block, built from the source
+// image's own EXIF data, into an already-encoded JPEG as an APP1 segment
+// immediately after the SOI marker.
+func embedExif(jpegBytes []byte, x *exif.Exif) ([]byte, error) {
+	if len(jpegBytes) < 2 || jpegBytes[0] != 0xFF || jpegBytes[1] != 0xD8 {
+		return nil, fmt.Errorf("not a jpeg stream")
+	}
+
+	payload, err := buildExifPayload(x)
+	if err != nil {
+		return nil, err
+	}
+	exifData := append([]byte("Exif\x00\x00"), payload...)
+
+	segLen := len(exifData) + 2
+	if segLen > 0xFFFF {
+		return nil, fmt.Errorf("exif block is too large to embed")
+	}
+
+	app1 := make([]byte, 0, 4+len(exifData))
+	app1 = append(app1, 0xFF, 0xE1, byte(segLen>>8), byte(segLen))
+	app1 = append(app1, exifData...)
+
+	out := make([]byte, 0, len(jpegBytes)+len(app1))
+	out = append(out, jpegBytes[:2]...)
+	out = append(out, app1...)
+	out = append(out, jpegBytes[2:]...)
+	return out, nil
+}
+
+// asciiField is one ASCII-valued IFD0 tag queued up for buildExifPayload.
+type asciiField struct {
+	tag   uint16
+	value []byte // the string's bytes plus a trailing NUL
+}
+
+// buildExifPayload re-encodes a handful of tags pulled from the source
+// image's EXIF data (Make, Model, Copyright, DateTimeOriginal, and GPS
+// position, whichever are present) as a minimal little-endian TIFF
+// structure, the format an "Exif\0\0" APP1 segment carries. DateTimeOriginal
+// lives in the Exif sub-IFD (tag 0x9003) that IFD0's 0x8769 pointer leads
+// to, not in IFD0 itself, same as a camera-written file: IFD0's own
+// 0x0132 is DateTime (file modification time), a different tag.
+func buildExifPayload(x *exif.Exif) ([]byte, error) {
+	var fields []asciiField
+	addASCII := func(tag uint16, name exif.FieldName) {
+		s, err := stringTag(x, name)
+		if err != nil || s == "" {
+			return
+		}
+		fields = append(fields, asciiField{tag: tag, value: append([]byte(s), 0)})
+	}
+	addASCII(0x010F, exif.Make)
+	addASCII(0x0110, exif.Model)
+	addASCII(0x8298, exif.Copyright)
+	sort.Slice(fields, func(i, j int) bool { return fields[i].tag < fields[j].tag })
+
+	dtOriginal, dtErr := stringTag(x, exif.DateTimeOriginal)
+	hasExifIFD := dtErr == nil && dtOriginal != ""
+
+	lat, lng, gpsErr := x.LatLong()
+	hasGPS := gpsErr == nil
+
+	numEntries := len(fields)
+	if hasExifIFD {
+		numEntries++ // Exif IFD pointer
+	}
+	if hasGPS {
+		numEntries++ // GPSInfo IFD pointer
+	}
+	if numEntries == 0 {
+		return nil, fmt.Errorf("no preservable exif fields found")
+	}
+
+	const ifd0HeaderSize = 8 // tiff byte order + magic + offset to IFD0
+	ifd0Size := 2 + numEntries*12 + 4
+	dataStart := uint32(ifd0HeaderSize + ifd0Size)
+
+	var ifd0, data0 bytes.Buffer
+	binary.Write(&ifd0, binary.LittleEndian, uint16(numEntries))
+
+	offset := dataStart
+	for _, f := range fields {
+		offset += writeDataEntry(&ifd0, &data0, f.tag, 2, uint32(len(f.value)), f.value, offset)
+	}
+
+	// Tags are written in ascending order (0x010F/0x0110/0x8298, then
+	// 0x8769, then 0x8825) to keep the IFD sorted, as the fields above are
+	// all numerically below the two pointer tags.
+	var exifSubIfd []byte
+	exifIfdOffset := offset
+	if hasExifIFD {
+		writeEntry(&ifd0, 0x8769, 4, 1, offsetValue(exifIfdOffset))
+		exifSubIfd = buildExifSubIfd(append([]byte(dtOriginal), 0), exifIfdOffset)
+	}
+
+	gpsIfdOffset := exifIfdOffset + uint32(len(exifSubIfd))
+	if hasGPS {
+		writeEntry(&ifd0, 0x8825, 4, 1, offsetValue(gpsIfdOffset))
+	}
+	binary.Write(&ifd0, binary.LittleEndian, uint32(0)) // no next IFD
+
+	payload := make([]byte, 0, ifd0HeaderSize+ifd0.Len()+data0.Len()+len(exifSubIfd))
+	payload = append(payload, 'I', 'I', 0x2A, 0x00)
+	payload = append(payload, 8, 0, 0, 0) // offset to IFD0
+	payload = append(payload, ifd0.Bytes()...)
+	payload = append(payload, data0.Bytes()...)
+
+	if hasExifIFD {
+		payload = append(payload, exifSubIfd...)
+	}
+	if hasGPS {
+		payload = append(payload, buildGPSIfd(lat, lng, gpsIfdOffset)...)
+	}
+
+	return payload, nil
+}
+
+// buildExifSubIfd builds the Exif sub-IFD that IFD0's 0x8769 pointer points
+// to, at the given absolute offset within the TIFF structure, holding
+// DateTimeOriginal (0x9003): the date the picture was taken, as opposed to
+// IFD0's own DateTime (0x0132, last file modification).
+func buildExifSubIfd(dtOriginal []byte, ifdOffset uint32) []byte {
+	const numEntries = 1
+	ifdSize := 2 + numEntries*12 + 4
+	dataStart := ifdOffset + uint32(ifdSize)
+
+	var ifd, data bytes.Buffer
+	binary.Write(&ifd, binary.LittleEndian, uint16(numEntries))
+	writeDataEntry(&ifd, &data, 0x9003, 2, uint32(len(dtOriginal)), dtOriginal, dataStart)
+	binary.Write(&ifd, binary.LittleEndian, uint32(0)) // no next IFD
+
+	out := make([]byte, 0, ifd.Len()+data.Len())
+	out = append(out, ifd.Bytes()...)
+	out = append(out, data.Bytes()...)
+	return out
+}
+
+// buildGPSIfd builds the GPS sub-IFD that IFD0's 0x8825 tag points to, at
+// the given absolute offset within the TIFF structure.
+func buildGPSIfd(lat, lng float64, ifdOffset uint32) []byte {
+	latRef, lat := "N", lat
+	if lat < 0 {
+		latRef, lat = "S", -lat
+	}
+	lngRef, lng := "E", lng
+	if lng < 0 {
+		lngRef, lng = "W", -lng
+	}
+
+	const numEntries = 4
+	ifdSize := 2 + numEntries*12 + 4
+	dataStart := ifdOffset + uint32(ifdSize)
+
+	var ifd, data bytes.Buffer
+	binary.Write(&ifd, binary.LittleEndian, uint16(numEntries))
+
+	offset := dataStart
+	offset += writeDataEntry(&ifd, &data, 0x0001, 2, 2, append([]byte(latRef), 0), offset) // GPSLatitudeRef
+	offset += writeDataEntry(&ifd, &data, 0x0002, 5, 3, dmsRational(lat), offset)          // GPSLatitude
+	offset += writeDataEntry(&ifd, &data, 0x0003, 2, 2, append([]byte(lngRef), 0), offset) // GPSLongitudeRef
+	offset += writeDataEntry(&ifd, &data, 0x0004, 5, 3, dmsRational(lng), offset)          // GPSLongitude
+
+	binary.Write(&ifd, binary.LittleEndian, uint32(0)) // no next IFD
+
+	out := make([]byte, 0, ifd.Len()+data.Len())
+	out = append(out, ifd.Bytes()...)
+	out = append(out, data.Bytes()...)
+	return out
+}
+
+// writeEntry appends one 12-byte IFD entry to buf: tag, type, count, and the
+// 4-byte value field, which per the TIFF spec holds either the value itself
+// (if it fits) or an offset to where it was written in the data area.
+func writeEntry(buf *bytes.Buffer, tag, typ uint16, count uint32, value [4]byte) {
+	binary.Write(buf, binary.LittleEndian, tag)
+	binary.Write(buf, binary.LittleEndian, typ)
+	binary.Write(buf, binary.LittleEndian, count)
+	buf.Write(value[:])
+}
+
+// offsetValue encodes offset as an IFD entry's 4-byte value field.
+func offsetValue(offset uint32) [4]byte {
+	var v [4]byte
+	binary.LittleEndian.PutUint32(v[:], offset)
+	return v
+}
+
+// entryValue returns the 4-byte value field for an entry holding raw: TIFF
+// requires values of 4 bytes or less to be stored inline, zero-padded,
+// rather than through an offset into the data area.
+func entryValue(raw []byte, offset uint32) [4]byte {
+	if len(raw) <= 4 {
+		var v [4]byte
+		copy(v[:], raw)
+		return v
+	}
+	return offsetValue(offset)
+}
+
+// writeDataEntry writes one IFD entry for raw at the given tag/type/count,
+// inlining raw in the entry itself when it's 4 bytes or less and otherwise
+// appending it to data at offset. It returns how much data area grew by, so
+// callers can advance offset for the next entry.
+func writeDataEntry(ifd, data *bytes.Buffer, tag, typ uint16, count uint32, raw []byte, offset uint32) uint32 {
+	writeEntry(ifd, tag, typ, count, entryValue(raw, offset))
+	if len(raw) <= 4 {
+		return 0
+	}
+	return writePadded(data, raw)
+}
+
+// writePadded appends v to buf, padding with a NUL byte if needed so the
+// next IFD entry's data stays 2-byte aligned, and returns how much the data
+// area grew by.
+func writePadded(buf *bytes.Buffer, v []byte) uint32 {
+	buf.Write(v)
+	n := len(v)
+	if n%2 != 0 {
+		buf.WriteByte(0)
+		n++
+	}
+	return uint32(n)
+}
+
+// dmsRational encodes a decimal degree value as three EXIF RATIONALs
+// (degrees, minutes, seconds), the layout GPSLatitude/GPSLongitude use.
+func dmsRational(deg float64) []byte {
+	d := math.Floor(deg)
+	minutesFull := (deg - d) * 60
+	m := math.Floor(minutesFull)
+	s := (minutesFull - m) * 60
+
+	buf := make([]byte, 0, 24)
+	for _, r := range [][2]uint32{
+		{uint32(d), 1},
+		{uint32(m), 1},
+		{uint32(math.Round(s * 1000)), 1000},
+	} {
+		n := make([]byte, 8)
+		binary.LittleEndian.PutUint32(n[0:4], r[0])
+		binary.LittleEndian.PutUint32(n[4:8], r[1])
+		buf = append(buf, n...)
+	}
+	return buf
+}
+
+func stringTag(x *exif.Exif, name exif.FieldName) (string, error) {
+	tag, err := x.Get(name)
+	if err != nil {
+		return "", err
 	}
+	return tag.StringVal()
 }